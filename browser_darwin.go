@@ -0,0 +1,9 @@
+//go:build darwin
+
+package deskauth
+
+import "os/exec"
+
+func openBrowser(url string) error {
+	return exec.Command("open", url).Start()
+}
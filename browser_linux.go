@@ -0,0 +1,9 @@
+//go:build linux
+
+package deskauth
+
+import "os/exec"
+
+func openBrowser(url string) error {
+	return exec.Command("xdg-open", url).Start()
+}
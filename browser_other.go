@@ -0,0 +1,9 @@
+//go:build !darwin && !linux && !windows
+
+package deskauth
+
+import "errors"
+
+func openBrowser(url string) error {
+	return errors.New("opening a browser is not supported on this platform")
+}
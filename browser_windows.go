@@ -0,0 +1,9 @@
+//go:build windows
+
+package deskauth
+
+import "os/exec"
+
+func openBrowser(url string) error {
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+}
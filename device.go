@@ -0,0 +1,175 @@
+package deskauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenSourceDevice returns an oauth2.TokenSource, doing the OAuth
+// 2.0 Device Authorization Grant (RFC 8628) as needed. Unlike
+// TokenSource, this flow never requires a local HTTP server or a
+// browser on the machine running the program, so it works from SSH
+// sessions, kiosks, and other headless desktops. The user completes
+// authentication on a separate device using a short code.
+func (a *Auth) TokenSourceDevice(ctx context.Context) (oauth2.TokenSource, error) {
+	tok, err := a.tokenFromStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		tok, err = a.tokenDevice(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil {
+			return nil, fmt.Errorf("device auth returned no error but also no token")
+		}
+		a.persistToken(tok)
+	}
+	return a.wrapTokenSource(a.Config.TokenSource(ctx, tok), tok), nil
+}
+
+// deviceAuthResponse is a device authorization endpoint's response,
+// as defined by RFC 8628 section 3.2. On failure (e.g. invalid_client,
+// invalid_scope), providers report it the same way as a token
+// endpoint, via the RFC 6749 section 5.2 error and error_description
+// fields.
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// deviceTokenResponse is a token endpoint's response to a device_code
+// grant poll: either a token, or an error as defined by RFC 8628
+// section 3.5.
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+
+	Error string `json:"error"`
+}
+
+func (a *Auth) tokenDevice(ctx context.Context) (*oauth2.Token, error) {
+	if a.ShowUserCode == nil {
+		return nil, errors.New("device authentication is unavailable")
+	}
+	if a.DeviceAuthURL == "" {
+		return nil, errors.New("Auth.DeviceAuthURL is not set")
+	}
+
+	form := url.Values{"client_id": {a.Config.ClientID}}
+	if len(a.Config.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Config.Scopes, " "))
+	}
+	da, status, err := postFormJSON[deviceAuthResponse](ctx, a.DeviceAuthURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("starting device authorization: %w", err)
+	}
+	if da.Error != "" {
+		if da.ErrorDescription != "" {
+			return nil, fmt.Errorf("device authorization endpoint returned error: %s (%s)", da.Error, da.ErrorDescription)
+		}
+		return nil, fmt.Errorf("device authorization endpoint returned error: %s", da.Error)
+	}
+	if da.DeviceCode == "" {
+		return nil, fmt.Errorf("device authorization endpoint returned no device_code (HTTP %d)", status)
+	}
+
+	verifyURL := da.VerificationURIComplete
+	if verifyURL == "" {
+		verifyURL = da.VerificationURI
+	}
+	if err := a.ShowUserCode(ctx, verifyURL, da.UserCode); err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(da.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(da.ExpiresIn) * time.Second)
+
+	form = url.Values{
+		"client_id":   {a.Config.ClientID},
+		"device_code": {da.DeviceCode},
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("device code expired before authorization completed")
+		}
+
+		tr, _, err := postFormJSON[deviceTokenResponse](ctx, a.Config.Endpoint.TokenURL, form)
+		if err != nil {
+			return nil, fmt.Errorf("polling for device token: %w", err)
+		}
+
+		switch tr.Error {
+		case "":
+			return &oauth2.Token{
+				AccessToken:  tr.AccessToken,
+				TokenType:    tr.TokenType,
+				RefreshToken: tr.RefreshToken,
+				Expiry:       time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second),
+			}, nil
+		case "authorization_pending":
+			// Keep polling at the current interval.
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return nil, errors.New("user denied device authorization")
+		case "expired_token":
+			return nil, errors.New("device code expired before authorization completed")
+		default:
+			return nil, fmt.Errorf("device token endpoint returned error: %s", tr.Error)
+		}
+	}
+}
+
+// postFormJSON POSTs form to endpoint and decodes the JSON response
+// body into a T, also returning the HTTP status code so callers can
+// report it when a response carries neither the expected fields nor
+// an error.
+func postFormJSON[T any](ctx context.Context, endpoint string, form url.Values) (*T, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var ret T
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("decoding response: %w", err)
+	}
+	return &ret, resp.StatusCode, nil
+}
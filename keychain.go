@@ -0,0 +1,76 @@
+package deskauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+)
+
+// KeychainStore returns a Storage that stores tokens in the host
+// OS's secret store: Keychain Services on macOS, Credential Manager
+// on Windows, and Secret Service (via libsecret/D-Bus) on Linux. This
+// is more appropriate than FileStore on shared machines, since the OS
+// keeps the secret out of reach of other users.
+//
+// service and account identify the stored secret, the same way they
+// would for any other keyring entry.
+func KeychainStore(service, account string) Storage {
+	return keychainStore{service: service, account: account}
+}
+
+type keychainStore struct {
+	service, account string
+}
+
+func (k keychainStore) Read() (*oauth2.Token, error) {
+	s, err := keyring.Get(k.service, k.account)
+	if errors.Is(err, keyring.ErrNotFound) {
+		// No cached token yet. Not an error, just no token.
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading token from keychain: %w", err)
+	}
+
+	var ret oauth2.Token
+	if err := json.Unmarshal([]byte(s), &ret); err != nil {
+		return nil, fmt.Errorf("unmarshaling auth config: %w", err)
+	}
+	return &ret, nil
+}
+
+func (k keychainStore) Write(tok *oauth2.Token) error {
+	bs, err := json.Marshal(tok)
+	if err != nil {
+		return fmt.Errorf("marshaling OAuth token: %w", err)
+	}
+
+	if err := keyring.Set(k.service, k.account, string(bs)); err != nil {
+		return fmt.Errorf("saving token to keychain: %w", err)
+	}
+	return nil
+}
+
+// DefaultStore returns a Storage that stores tokens in the most
+// appropriate place for the current environment: the OS keychain
+// when one is usable, or a file managed by DefaultFileStore
+// otherwise, e.g. on a headless Linux server with no D-Bus session.
+func DefaultStore(appName string) Storage {
+	if keychainAvailable() {
+		return KeychainStore(appName, "oauth-token")
+	}
+	return DefaultFileStore(appName)
+}
+
+// keychainAvailable reports whether the OS keychain backing
+// KeychainStore is usable. The probe is read-only: a missing entry
+// means the keychain backend itself is reachable and just has
+// nothing stored under this name yet, while other errors (e.g. no
+// D-Bus session on headless Linux) mean the backend isn't usable.
+func keychainAvailable() bool {
+	const probeService, probeAccount = "deskauth-probe", "probe"
+	_, err := keyring.Get(probeService, probeAccount)
+	return err == nil || errors.Is(err, keyring.ErrNotFound)
+}
@@ -3,8 +3,11 @@
 package deskauth
 
 import (
+	"bufio"
 	"context"
 	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -13,8 +16,11 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"golang.org/x/oauth2"
 )
@@ -40,6 +46,130 @@ type Auth struct {
 	// authentication. If nil, interactive auth is disabled and
 	// Storage must be able to provide a stored token.
 	ShowURL func(context.Context, string) error
+
+	// DeviceAuthURL is the provider's device authorization endpoint,
+	// as defined by RFC 8628. It is required by TokenSourceDevice.
+	// oauth2.Config has no equivalent field, since the device flow
+	// isn't part of the base OAuth2 spec.
+	DeviceAuthURL string
+	// ShowUserCode is a function that displays the user code and
+	// verification URL for the device authorization flow, started by
+	// TokenSourceDevice. If nil, device authentication is disabled and
+	// Storage must be able to provide a stored token.
+	ShowUserCode func(ctx context.Context, verificationURI, userCode string) error
+
+	// DisablePKCE disables use of PKCE (RFC 7636) in the interactive
+	// loopback flow. PKCE is used by default because it lets native
+	// and desktop clients authenticate safely without embedding a
+	// real client secret in the binary; providers that don't support
+	// it simply ignore the extra parameters.
+	DisablePKCE bool
+
+	// ManualCode selects an out-of-band authentication mode for
+	// environments that can't bind a local HTTP listener or receive a
+	// browser redirect at all, such as a restricted corporate
+	// machine or an SSH session to a remote, firewalled host. Instead
+	// of running a local HTTP server, Config.RedirectURL is used
+	// as-is (set it to a caller-registered out-of-band value such as
+	// "urn:ietf:wg:oauth:2.0:oob", or a public URL the caller
+	// controls), and the resulting authorization code is read with
+	// ReadCode.
+	ManualCode bool
+	// ReadCode reads the authorization code after the user completes
+	// authentication out-of-band. It may return either the raw code,
+	// or the full URL the caller was redirected to, in which case the
+	// code and state are extracted from its query parameters. If nil,
+	// ReadCode defaults to reading a line from standard input.
+	ReadCode func(ctx context.Context) (string, error)
+
+	// OnTokenRefresh, if set, is called whenever the TokenSource
+	// returned by TokenSource or TokenSourceDevice obtains a new
+	// token, e.g. via a transparent access token refresh. It runs
+	// after the new token is persisted to Storage.
+	OnTokenRefresh func(*oauth2.Token) error
+
+	// SuccessPage, if set, handles the browser request that lands on
+	// the local HTTP server after a successful interactive
+	// authentication, in place of the default "you may close this
+	// window" message. Use this to show branded confirmation, or to
+	// redirect back to a landing page.
+	SuccessPage http.Handler
+
+	// ListenAddr is the address the local HTTP server in the
+	// interactive flow listens on, e.g. "127.0.0.1:8765". If empty,
+	// it defaults to "localhost:0", i.e. a random port. Some
+	// providers (Google, Microsoft, and others) require the redirect
+	// URI to be pre-registered, which a random port can't satisfy;
+	// set ListenAddr to a fixed, pre-registered port in that case.
+	//
+	// ListenAddrs takes precedence over ListenAddr if both are set.
+	ListenAddr string
+	// ListenAddrs is a list of candidate addresses for the local HTTP
+	// server, tried in order until one binds successfully. List a
+	// preferred fixed port first and fallback ports after it, in case
+	// the preferred one is already in use. ListenAddr is not tried
+	// when ListenAddrs is set.
+	ListenAddrs []string
+	// RedirectPath is the URL path component of the local HTTP
+	// server's redirect URI, e.g. "/callback". If empty, a random
+	// path is used. A leading "/" is added if missing. Set this to
+	// match a pre-registered redirect URI that includes a specific
+	// path.
+	RedirectPath string
+}
+
+// listen opens the local HTTP listener for the interactive flow,
+// trying ListenAddrs (or ListenAddr, if ListenAddrs is empty) in
+// order and returning the listener for the first one that succeeds,
+// along with the configured address (pre-resolution) that it bound.
+func (a *Auth) listen() (net.Listener, string, error) {
+	addrs := a.ListenAddrs
+	if len(addrs) == 0 {
+		addr := a.ListenAddr
+		if addr == "" {
+			addr = "localhost:0"
+		}
+		addrs = []string{addr}
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			return ln, addr, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, "", fmt.Errorf("creating socket for local HTTP server: %w", errors.Join(errs...))
+}
+
+// redirectHost returns the host:port to use in the redirect URL for a
+// listener bound to configuredAddr. It keeps the configured host
+// literally (e.g. "localhost" or a fixed IP) so that a pre-registered
+// redirect URI matches, substituting in the listener's actual bound
+// port only when the configured port was the wildcard "0".
+func redirectHost(configuredAddr string, ln net.Listener) string {
+	host, port, err := net.SplitHostPort(configuredAddr)
+	if err != nil {
+		return ln.Addr().String()
+	}
+	if port == "0" {
+		_, port, err = net.SplitHostPort(ln.Addr().String())
+		if err != nil {
+			return ln.Addr().String()
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (a *Auth) successPage() http.Handler {
+	if a.SuccessPage != nil {
+		return a.SuccessPage
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html><body><h2>Authentication successful, you may close this window</h2></body></html>")
+	})
 }
 
 // PrintURL is an Auth.ShowURL function that prints the authentication
@@ -49,6 +179,19 @@ func PrintURL(ctx context.Context, url string) error {
 	return nil
 }
 
+// OpenBrowser is an Auth.ShowURL function that opens url in the
+// user's default browser. If the platform's browser-opening command
+// can't be started, e.g. because it isn't installed or the platform
+// has none, it falls back to PrintURL so authentication can still
+// proceed. A failure of that command after it has started is not
+// detected, and the URL is then not printed.
+func OpenBrowser(ctx context.Context, url string) error {
+	if err := openBrowser(url); err != nil {
+		return PrintURL(ctx, url)
+	}
+	return nil
+}
+
 // FileStore returns a Storage that stores tokens at filename. Any
 // missing parent directories are created with mode 0700.
 func FileStore(filename string) Storage {
@@ -117,16 +260,21 @@ func (a *Auth) TokenSource(ctx context.Context) (oauth2.TokenSource, error) {
 		return nil, err
 	}
 	if tok != nil {
-		return a.Config.TokenSource(ctx, tok), nil
+		return a.wrapTokenSource(a.Config.TokenSource(ctx, tok), tok), nil
+	}
+	if a.ManualCode {
+		tok, err = a.tokenManual(ctx)
+	} else {
+		tok, err = a.tokenInteractive(ctx)
 	}
-	tok, err = a.tokenInteractive(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if tok == nil {
 		return nil, fmt.Errorf("interactive auth returned no error but also no token")
 	}
-	return a.Config.TokenSource(ctx, tok), nil
+	a.persistToken(tok)
+	return a.wrapTokenSource(a.Config.TokenSource(ctx, tok), tok), nil
 }
 
 // HTTP returns an http.Client that adds OAuth bearer token
@@ -135,6 +283,60 @@ func HTTP(ctx context.Context, src oauth2.TokenSource) *http.Client {
 	return oauth2.NewClient(ctx, src)
 }
 
+// persistToken saves tok to Storage, if set. A write failure isn't
+// fatal: tok is still valid and usable, e.g. even if the keychain is
+// momentarily locked, so the failure is ignored rather than returned
+// to the caller.
+func (a *Auth) persistToken(tok *oauth2.Token) {
+	if a.Storage == nil {
+		return
+	}
+	a.Storage.Write(tok)
+}
+
+// wrapTokenSource wraps src so that whenever it produces a token
+// other than the last one it produced (initially tok), the new token
+// is persisted to Storage and announced
+// via OnTokenRefresh. oauth2.Config.TokenSource refreshes expired
+// access tokens transparently, and without this wrapper the refreshed
+// token is never saved, which breaks providers that rotate refresh
+// tokens on use.
+func (a *Auth) wrapTokenSource(src oauth2.TokenSource, tok *oauth2.Token) oauth2.TokenSource {
+	return &refreshNotifySource{a: a, src: src, last: tok}
+}
+
+type refreshNotifySource struct {
+	a   *Auth
+	src oauth2.TokenSource
+
+	mu   sync.Mutex
+	last *oauth2.Token
+}
+
+func (s *refreshNotifySource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	changed := s.last == nil || tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken
+	s.last = tok
+	s.mu.Unlock()
+
+	if changed {
+		s.a.persistToken(tok)
+		if s.a.OnTokenRefresh != nil {
+			// As with the Storage.Write above, tok is still valid
+			// and usable even if the notification callback fails, so
+			// its error isn't returned here either.
+			s.a.OnTokenRefresh(tok)
+		}
+	}
+
+	return tok, nil
+}
+
 func (a *Auth) tokenFromStorage(ctx context.Context) (*oauth2.Token, error) {
 	if a.Storage == nil {
 		return nil, nil
@@ -148,18 +350,36 @@ func (a *Auth) tokenInteractive(ctx context.Context) (*oauth2.Token, error) {
 		return nil, errors.New("interactive authentication is unavailable")
 	}
 
-	path := "/" + randhex()
-	ln, err := net.Listen("tcp", "localhost:0")
+	path := a.RedirectPath
+	if path == "" {
+		path = "/" + randhex()
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	ln, configuredAddr, err := a.listen()
 	if err != nil {
-		return nil, fmt.Errorf("creating socket for local HTTP server: %w", err)
+		return nil, err
 	}
 	defer ln.Close()
 
-	cfg := a.Config
-	cfg.RedirectURL = fmt.Sprintf("http://%s%s", ln.Addr(), path)
+	cfgCopy := *a.Config
+	cfg := &cfgCopy
+	cfg.RedirectURL = fmt.Sprintf("http://%s%s", redirectHost(configuredAddr, ln), path)
+
+	var authOpts, exchangeOpts []oauth2.AuthCodeOption
+	if !a.DisablePKCE {
+		verifier, err := codeVerifier()
+		if err != nil {
+			return nil, fmt.Errorf("generating PKCE code verifier: %w", err)
+		}
+		authOpts = append(authOpts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", verifier))
+	}
 
 	state := randhex()
-	startURL := cfg.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	startURL := cfg.AuthCodeURL(state, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, authOpts...)...)
 
 	type resp struct {
 		code string
@@ -195,8 +415,7 @@ func (a *Auth) tokenInteractive(ctx context.Context) (*oauth2.Token, error) {
 			default:
 			}
 
-			w.Header().Set("Content-Type", "text/html")
-			io.WriteString(w, "<html><body><h2>Authentication successful, you may close this window</h2></body></html>")
+			a.successPage().ServeHTTP(w, r)
 		}),
 	}
 	go func() {
@@ -217,12 +436,95 @@ func (a *Auth) tokenInteractive(ctx context.Context) (*oauth2.Token, error) {
 		if rsp.err != nil {
 			return nil, rsp.err
 		}
-		return cfg.Exchange(ctx, rsp.code, oauth2.AccessTypeOffline)
+		return cfg.Exchange(ctx, rsp.code, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, exchangeOpts...)...)
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
+func (a *Auth) tokenManual(ctx context.Context) (*oauth2.Token, error) {
+	if a.ShowURL == nil {
+		return nil, errors.New("interactive authentication is unavailable")
+	}
+	readCode := a.ReadCode
+	if readCode == nil {
+		readCode = readCodeStdin
+	}
+
+	// Unlike tokenInteractive, RedirectURL is left as the caller set
+	// it: it must already be an out-of-band value registered with
+	// the provider.
+	cfg := a.Config
+
+	var authOpts, exchangeOpts []oauth2.AuthCodeOption
+	if !a.DisablePKCE {
+		verifier, err := codeVerifier()
+		if err != nil {
+			return nil, fmt.Errorf("generating PKCE code verifier: %w", err)
+		}
+		authOpts = append(authOpts,
+			oauth2.SetAuthURLParam("code_challenge", codeChallengeS256(verifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+		exchangeOpts = append(exchangeOpts, oauth2.SetAuthURLParam("code_verifier", verifier))
+	}
+
+	state := randhex()
+	startURL := cfg.AuthCodeURL(state, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, authOpts...)...)
+
+	if err := a.ShowURL(ctx, startURL); err != nil {
+		return nil, err
+	}
+
+	input, err := readCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	code, err := parseManualCode(input, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.Exchange(ctx, code, append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, exchangeOpts...)...)
+}
+
+// parseManualCode extracts an authorization code from input, which is
+// either a raw code or the full URL the user was redirected to. In
+// the latter case, state is checked against the query parameter of
+// the same name, if present.
+func parseManualCode(input, state string) (string, error) {
+	input = strings.TrimSpace(input)
+
+	u, err := url.Parse(input)
+	if err != nil || u.Scheme == "" || u.RawQuery == "" {
+		// Doesn't look like a URL; treat it as a raw code.
+		return input, nil
+	}
+
+	q := u.Query()
+	if st := q.Get("state"); st != "" && st != state {
+		return "", errors.New("bad state")
+	}
+	if errStr := q.Get("error"); errStr != "" {
+		return "", fmt.Errorf("OAuth server returned error: %s", errStr)
+	}
+	code := q.Get("code")
+	if code == "" {
+		return "", errors.New("pasted URL has no authorization code")
+	}
+	return code, nil
+}
+
+// readCodeStdin is the default Auth.ReadCode, which prompts on
+// standard output and reads from standard input.
+func readCodeStdin(ctx context.Context) (string, error) {
+	fmt.Print("Enter the authorization code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
 func randhex() string {
 	var bs [8]byte
 	if _, err := io.ReadFull(crand.Reader, bs[:]); err != nil {
@@ -230,3 +532,20 @@ func randhex() string {
 	}
 	return hex.EncodeToString(bs[:])
 }
+
+// codeVerifier returns a random PKCE code_verifier, as defined by RFC
+// 7636 section 4.1.
+func codeVerifier() (string, error) {
+	var bs [32]byte
+	if _, err := io.ReadFull(crand.Reader, bs[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bs[:]), nil
+}
+
+// codeChallengeS256 derives a PKCE code_challenge from verifier using
+// the S256 transform (RFC 7636 section 4.2).
+func codeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}